@@ -0,0 +1,361 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const activityCollection = "activities"
+const remoteActorCollection = "remote_actors"
+const asContext = "https://www.w3.org/ns/activitystreams"
+
+// apDomain returns the public hostname ratesvc is served under, used to build AS2 IDs
+func apDomain() (string, error) {
+	domain, ok := os.LookupEnv("AP_DOMAIN")
+	if !ok {
+		return "", fmt.Errorf("AP_DOMAIN not set")
+	}
+	return domain, nil
+}
+
+// apActor is the AS2 Actor document for an item, served at GET /ap/items/{id}
+type apActor struct {
+	Context           string      `json:"@context"`
+	ID                string      `json:"id"`
+	Type              string      `json:"type"`
+	PreferredUsername string      `json:"preferredUsername"`
+	Inbox             string      `json:"inbox"`
+	Outbox            string      `json:"outbox"`
+	PublicKey         apPublicKey `json:"publicKey"`
+}
+
+type apPublicKey struct {
+	ID           string `json:"id"`
+	Owner        string `json:"owner"`
+	PublicKeyPem string `json:"publicKeyPem"`
+}
+
+// apActivity is a generic AS2 activity, used both for the activities we persist/deliver
+// and for the ones we accept in an item's inbox
+type apActivity struct {
+	Context   string      `json:"@context,omitempty"`
+	ID        string      `json:"id,omitempty" bson:"_id,omitempty"`
+	Type      string      `json:"type"`
+	Actor     string      `json:"actor"`
+	Object    interface{} `json:"object"`
+	Published time.Time   `json:"published,omitempty"`
+	ItemID    string      `json:"-" bson:"item_id,omitempty"`
+}
+
+// apNote is the AS2 object a comment is represented as
+type apNote struct {
+	ID           string    `json:"id"`
+	Type         string    `json:"type"`
+	AttributedTo string    `json:"attributedTo"`
+	Content      string    `json:"content"`
+	InReplyTo    string    `json:"inReplyTo,omitempty"`
+	Published    time.Time `json:"published"`
+}
+
+// remoteActor caches a remote actor's inbox and public key, fetched the first time we
+// see an activity signed by them, and used both to verify future signatures and to know
+// which remote inboxes to deliver an item's local activities to.
+type remoteActor struct {
+	ID           string    `bson:"_id"`
+	Inbox        string    `bson:"inbox"`
+	PublicKeyPem string    `bson:"public_key_pem"`
+	FetchedAt    time.Time `bson:"fetched_at"`
+}
+
+func itemActorID(domain, itemID string) string {
+	return fmt.Sprintf("https://%s/ap/items/%s", domain, itemID)
+}
+
+// getActor serves an item's AS2 Actor document
+func getActor(w http.ResponseWriter, req *http.Request) {
+	itemID := mux.Vars(req)["id"]
+	domain, err := apDomain()
+	if err != nil {
+		log.WithError(err).Error("AP_DOMAIN not configured")
+		response.NewErrorResponse(http.StatusInternalServerError, "federation is not configured").Write(w)
+		return
+	}
+
+	db, closer := dbSession.DB()
+	defer closer()
+	if err := db.C(itemCollection).FindId(itemID).One(&item{}); err != nil {
+		response.NewErrorResponse(http.StatusNotFound, "item not found").Write(w)
+		return
+	}
+
+	actorID := itemActorID(domain, itemID)
+	actor := apActor{
+		Context:           asContext,
+		ID:                actorID,
+		Type:              "Service",
+		PreferredUsername: itemID,
+		Inbox:             actorID + "/inbox",
+		Outbox:            actorID + "/outbox",
+		PublicKey: apPublicKey{
+			ID:           actorID + "#main-key",
+			Owner:        actorID,
+			PublicKeyPem: apPublicKeyPem(),
+		},
+	}
+
+	w.Header().Set("Content-Type", "application/activity+json")
+	json.NewEncoder(w).Encode(&actor)
+}
+
+// getOutbox lists the recent activities emitted for an item as an AS2 OrderedCollection
+func getOutbox(w http.ResponseWriter, req *http.Request) {
+	itemID := mux.Vars(req)["id"]
+	domain, err := apDomain()
+	if err != nil {
+		log.WithError(err).Error("AP_DOMAIN not configured")
+		response.NewErrorResponse(http.StatusInternalServerError, "federation is not configured").Write(w)
+		return
+	}
+
+	db, closer := dbSession.DB()
+	defer closer()
+
+	var activities []apActivity
+	if err := db.C(activityCollection).Find(bson.M{"item_id": itemID}).Sort("-published").Limit(defaultCommentsLimit).All(&activities); err != nil {
+		log.WithError(err).Error("could not fetch outbox")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch outbox").Write(w)
+		return
+	}
+
+	collection := struct {
+		Context      string       `json:"@context"`
+		ID           string       `json:"id"`
+		Type         string       `json:"type"`
+		TotalItems   int          `json:"totalItems"`
+		OrderedItems []apActivity `json:"orderedItems"`
+	}{
+		Context:      asContext,
+		ID:           itemActorID(domain, itemID) + "/outbox",
+		Type:         "OrderedCollection",
+		TotalItems:   len(activities),
+		OrderedItems: activities,
+	}
+
+	w.Header().Set("Content-Type", "application/activity+json")
+	json.NewEncoder(w).Encode(&collection)
+}
+
+// webFinger resolves acct:{itemID}@{domain} to the item's actor URL
+func webFinger(w http.ResponseWriter, req *http.Request) {
+	domain, err := apDomain()
+	if err != nil {
+		log.WithError(err).Error("AP_DOMAIN not configured")
+		response.NewErrorResponse(http.StatusInternalServerError, "federation is not configured").Write(w)
+		return
+	}
+
+	resource := req.URL.Query().Get("resource")
+	prefix := "acct:"
+	suffix := "@" + domain
+	if len(resource) <= len(prefix)+len(suffix) || resource[:len(prefix)] != prefix || resource[len(resource)-len(suffix):] != suffix {
+		response.NewErrorResponse(http.StatusBadRequest, "invalid resource").Write(w)
+		return
+	}
+	itemID := resource[len(prefix) : len(resource)-len(suffix)]
+
+	db, closer := dbSession.DB()
+	defer closer()
+	if err := db.C(itemCollection).FindId(itemID).One(&item{}); err != nil {
+		response.NewErrorResponse(http.StatusNotFound, "item not found").Write(w)
+		return
+	}
+
+	jrd := struct {
+		Subject string `json:"subject"`
+		Links   []struct {
+			Rel  string `json:"rel"`
+			Type string `json:"type"`
+			Href string `json:"href"`
+		} `json:"links"`
+	}{Subject: resource}
+	jrd.Links = append(jrd.Links, struct {
+		Rel  string `json:"rel"`
+		Type string `json:"type"`
+		Href string `json:"href"`
+	}{Rel: "self", Type: "application/activity+json", Href: itemActorID(domain, itemID)})
+
+	w.Header().Set("Content-Type", "application/jrd+json")
+	json.NewEncoder(w).Encode(&jrd)
+}
+
+// inbox accepts Like, Undo{Like} and Create{Note} activities from remote actors
+func inbox(w http.ResponseWriter, req *http.Request) {
+	itemID := mux.Vars(req)["id"]
+
+	actorID, err := verifyHTTPSignature(req)
+	if err != nil {
+		log.WithError(err).Error("could not verify HTTP signature")
+		response.NewErrorResponse(http.StatusUnauthorized, "invalid signature").Write(w)
+		return
+	}
+
+	var activity apActivity
+	if err := json.NewDecoder(req.Body).Decode(&activity); err != nil {
+		log.WithError(err).Error("could not parse activity")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse activity").Write(w)
+		return
+	}
+	if activity.Actor != actorID {
+		response.NewErrorResponse(http.StatusForbidden, "actor does not match signature").Write(w)
+		return
+	}
+
+	db, closer := dbSession.DB()
+	defer closer()
+
+	switch activity.Type {
+	case "Like":
+		err = db.C(itemCollection).UpdateId(itemID, bson.M{"$addToSet": bson.M{"remote_stargazer_ids": actorID}})
+	case "Undo":
+		err = db.C(itemCollection).UpdateId(itemID, bson.M{"$pull": bson.M{"remote_stargazer_ids": actorID}})
+	case "Create":
+		err = receiveRemoteNote(db, itemID, actorID, activity)
+	default:
+		response.NewErrorResponse(http.StatusBadRequest, "unsupported activity type").Write(w)
+		return
+	}
+	if err != nil {
+		log.WithError(err).Error("could not process activity")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not process activity").Write(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// receiveRemoteNote persists a Note created by a remote actor as a top-level comment
+func receiveRemoteNote(db *mgo.Database, itemID, actorID string, activity apActivity) error {
+	raw, err := json.Marshal(activity.Object)
+	if err != nil {
+		return err
+	}
+	var note apNote
+	if err := json.Unmarshal(raw, &note); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	c := &Comment{
+		ID:            bson.NewObjectId(),
+		ItemID:        itemID,
+		RemoteActorID: actorID,
+		Body:          note.Content,
+		CreatedAt:     now,
+		UpdatedAt:     now,
+	}
+	return db.C(commentCollection).Insert(c)
+}
+
+// emitStarActivity emits a Like when an item is starred, or Undo{Like} when unstarred
+func emitStarActivity(itemID string, starred bool) {
+	domain, err := apDomain()
+	if err != nil {
+		return
+	}
+	actorID := itemActorID(domain, itemID)
+	like := apActivity{Context: asContext, Type: "Like", Actor: actorID, Object: actorID}
+	if starred {
+		emitActivity(itemID, "Like", actorID)
+		return
+	}
+	emitActivity(itemID, "Undo", like)
+}
+
+// emitCommentActivity emits a Create{Note} when a local comment is posted
+func emitCommentActivity(itemID string, c *Comment) {
+	domain, err := apDomain()
+	if err != nil {
+		return
+	}
+	actorID := itemActorID(domain, itemID)
+	note := apNote{
+		ID:           fmt.Sprintf("%s/comments/%s", actorID, c.ID.Hex()),
+		Type:         "Note",
+		AttributedTo: actorID,
+		Content:      c.Body,
+		InReplyTo:    actorID,
+		Published:    c.CreatedAt,
+	}
+	emitActivity(itemID, "Create", note)
+}
+
+// emitActivity persists a local activity to the item's outbox and delivers it to every
+// remote actor cached in remote_actors (not only those that interacted with this item),
+// retrying transient failures.
+func emitActivity(itemID, activityType string, object interface{}) {
+	domain, err := apDomain()
+	if err != nil {
+		return
+	}
+	db, closer := dbSession.DB()
+	defer closer()
+
+	actorID := itemActorID(domain, itemID)
+	activity := apActivity{
+		Context:   asContext,
+		ID:        fmt.Sprintf("%s/outbox/%s", actorID, bson.NewObjectId().Hex()),
+		Type:      activityType,
+		Actor:     actorID,
+		Object:    object,
+		Published: time.Now(),
+		ItemID:    itemID,
+	}
+	if err := db.C(activityCollection).Insert(&activity); err != nil {
+		log.WithError(err).Error("could not persist activity")
+		return
+	}
+
+	var followers []remoteActor
+	if err := db.C(remoteActorCollection).Find(nil).All(&followers); err != nil {
+		log.WithError(err).Error("could not list remote actors")
+		return
+	}
+	for _, f := range followers {
+		go deliverActivity(activity, f.Inbox)
+	}
+}
+
+// GetActor, GetOutbox, WebFinger and Inbox are the federation endpoints gated behind the
+// "federation" license feature
+var (
+	GetActor  = requireFeature("federation", getActor)
+	GetOutbox = requireFeature("federation", getOutbox)
+	WebFinger = requireFeature("federation", webFinger)
+	Inbox     = requireFeature("federation", inbox)
+)
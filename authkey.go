@@ -0,0 +1,344 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+
+	"golang.org/x/crypto/bcrypt"
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const keyCollection = "keys"
+
+const keyIDLength = 8
+const keySecretLength = 32
+const keyIDAlphabet = "abcdefghijklmnopqrstuvwxyz0123456789"
+
+// Scope names a key can be restricted to
+const (
+	scopeRead  = "read"
+	scopeWrite = "write"
+)
+
+// maxKeyFailures is how many bad secrets a key tolerates within keyFailureWindow before its
+// cooldown kicks in
+const maxKeyFailures = 10
+
+// keyFailureWindow is how long a failure counts toward maxKeyFailures; a key that's been quiet
+// for longer than this gets a clean slate, so failures don't accumulate forever
+const keyFailureWindow = 10 * time.Minute
+
+// keyLockoutBase and keyLockoutMax bound the exponential cooldown applied once a key exceeds
+// maxKeyFailures: it starts short and doubles with each further failure, capped at keyLockoutMax,
+// so a key is never locked out permanently the way a bare failure counter would leave it.
+const keyLockoutBase = 5 * time.Second
+const keyLockoutMax = 15 * time.Minute
+
+// accessKey is an S3-style access key that can authenticate API requests in place of the
+// ka_auth cookie, scoped to either read-only or read-write access
+type accessKey struct {
+	ID         string        `json:"key_id" bson:"_id"`
+	SecretHash string        `json:"-" bson:"secret_hash"`
+	UserID     bson.ObjectId `json:"user_id" bson:"user_id"`
+	Label      string        `json:"label" bson:"label"`
+	Scopes     []string      `json:"scopes" bson:"scopes"`
+	CreatedAt  time.Time     `json:"created_at" bson:"created_at"`
+	LastUsedAt time.Time     `json:"last_used_at,omitempty" bson:"last_used_at,omitempty"`
+	RevokedAt  *time.Time    `json:"revoked_at,omitempty" bson:"revoked_at,omitempty"`
+}
+
+// keyFailureState tracks a key_id's recent secret-compare failures
+type keyFailureState struct {
+	count       int
+	lastFailure time.Time
+	lockedUntil time.Time
+}
+
+// keyRateLimiter tracks recent secret-compare failures per key_id to resist brute-forcing.
+// Failures older than keyFailureWindow are forgotten, and a key that keeps failing gets an
+// exponentially growing (but always-expiring) cooldown rather than a permanent lockout, since
+// key_id isn't secret and a permanent counter would let anyone DoS a legitimate key forever.
+type keyRateLimiter struct {
+	mu    sync.Mutex
+	state map[string]*keyFailureState
+}
+
+func (l *keyRateLimiter) allowed(keyID string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s, ok := l.state[keyID]
+	if !ok {
+		return true
+	}
+	return time.Now().After(s.lockedUntil)
+}
+
+func (l *keyRateLimiter) recordFailure(keyID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	s, ok := l.state[keyID]
+	if !ok || now.Sub(s.lastFailure) > keyFailureWindow {
+		s = &keyFailureState{}
+		l.state[keyID] = s
+	}
+	s.count++
+	s.lastFailure = now
+
+	if s.count > maxKeyFailures {
+		cooldown := keyLockoutBase << uint(s.count-maxKeyFailures-1)
+		if cooldown <= 0 || cooldown > keyLockoutMax {
+			cooldown = keyLockoutMax
+		}
+		s.lockedUntil = now.Add(cooldown)
+	}
+}
+
+func (l *keyRateLimiter) reset(keyID string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.state, keyID)
+}
+
+var keyLimiter = &keyRateLimiter{state: map[string]*keyFailureState{}}
+
+// generateKeyToken returns a random string of n characters drawn from keyIDAlphabet
+func generateKeyToken(n int) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < n; i++ {
+		idx, err := rand.Int(rand.Reader, big.NewInt(int64(len(keyIDAlphabet))))
+		if err != nil {
+			return "", err
+		}
+		sb.WriteByte(keyIDAlphabet[idx.Int64()])
+	}
+	return sb.String(), nil
+}
+
+// authenticateWithKey validates an Authorization: Bearer {key_id}:{secret} header against
+// the keys collection, returning the key's owner and granted scopes
+func authenticateWithKey(req *http.Request) (bson.ObjectId, []string, error) {
+	authHeader := req.Header.Get("Authorization")
+	const prefix = "Bearer "
+	if !strings.HasPrefix(authHeader, prefix) {
+		return "", nil, errors.New("missing Authorization header")
+	}
+
+	token := strings.TrimPrefix(authHeader, prefix)
+	parts := strings.SplitN(token, ":", 2)
+	if len(parts) != 2 {
+		return "", nil, errors.New("malformed access key")
+	}
+	keyID, secret := parts[0], parts[1]
+
+	if !keyLimiter.allowed(keyID) {
+		return "", nil, errors.New("access key locked out after too many failed attempts")
+	}
+
+	db, closer := dbSession.DB()
+	defer closer()
+
+	var key accessKey
+	if err := db.C(keyCollection).FindId(keyID).One(&key); err != nil {
+		keyLimiter.recordFailure(keyID)
+		return "", nil, errors.New("invalid access key")
+	}
+	if key.RevokedAt != nil {
+		return "", nil, errors.New("access key revoked")
+	}
+
+	if err := bcrypt.CompareHashAndPassword([]byte(key.SecretHash), []byte(secret)); err != nil {
+		keyLimiter.recordFailure(keyID)
+		return "", nil, errors.New("invalid access key")
+	}
+	keyLimiter.reset(keyID)
+
+	if err := db.C(keyCollection).UpdateId(keyID, bson.M{"$set": bson.M{"last_used_at": time.Now()}}); err != nil {
+		log.WithError(err).Warn("could not update access key last_used_at")
+	}
+
+	return key.UserID, key.Scopes, nil
+}
+
+// requireScope authenticates the request and ensures the granted scopes include scope.
+// A session authenticated via the ka_auth cookie is always fully scoped; only access keys
+// are restricted to the scopes they were created with.
+func requireScope(req *http.Request, scope string) (bson.ObjectId, error) {
+	if uid, err := getCurrentUserIDFromCookie(req); err == nil {
+		return uid, nil
+	}
+
+	uid, scopes, err := authenticateWithKey(req)
+	if err != nil {
+		return "", err
+	}
+	for _, s := range scopes {
+		if s == scope {
+			return uid, nil
+		}
+	}
+	return "", errors.New("insufficient scope")
+}
+
+// CreateAccessKey mints a new access key for a user, admin-only. The plaintext secret is
+// only ever returned in this response.
+func CreateAccessKey(w http.ResponseWriter, req *http.Request) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	if !isAdminRequest(db, req) {
+		response.NewErrorResponse(http.StatusForbidden, "admin access required").Write(w)
+		return
+	}
+
+	var body struct {
+		UserID bson.ObjectId `json:"user_id"`
+		Label  string        `json:"label"`
+		Scopes []string      `json:"scopes"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		log.WithError(err).Error("could not parse request body")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse request body").Write(w)
+		return
+	}
+	if body.UserID == "" {
+		response.NewErrorResponse(http.StatusBadRequest, "user_id is required").Write(w)
+		return
+	}
+	for _, s := range body.Scopes {
+		if s != scopeRead && s != scopeWrite {
+			response.NewErrorResponse(http.StatusBadRequest, "invalid scope").Write(w)
+			return
+		}
+	}
+	if len(body.Scopes) == 0 {
+		body.Scopes = []string{scopeRead}
+	}
+
+	keyID, err := generateKeyToken(keyIDLength)
+	if err != nil {
+		log.WithError(err).Error("could not generate key id")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	secret, err := generateKeyToken(keySecretLength)
+	if err != nil {
+		log.WithError(err).Error("could not generate key secret")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+	secretHash, err := bcrypt.GenerateFromPassword([]byte(secret), bcrypt.DefaultCost)
+	if err != nil {
+		log.WithError(err).Error("could not hash key secret")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	}
+
+	key := &accessKey{
+		ID:         keyID,
+		SecretHash: string(secretHash),
+		UserID:     body.UserID,
+		Label:      body.Label,
+		Scopes:     body.Scopes,
+		CreatedAt:  time.Now(),
+	}
+	if err := db.C(keyCollection).Insert(key); err != nil {
+		log.WithError(err).Error("could not create access key")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not create access key").Write(w)
+		return
+	}
+
+	response.NewDataResponse(struct {
+		*accessKey
+		Secret string `json:"secret"`
+	}{accessKey: key, Secret: secret}).WithCode(http.StatusCreated).Write(w)
+}
+
+// ListAccessKeys lists all access keys, admin-only. Secrets are never returned here.
+func ListAccessKeys(w http.ResponseWriter, req *http.Request) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	if !isAdminRequest(db, req) {
+		response.NewErrorResponse(http.StatusForbidden, "admin access required").Write(w)
+		return
+	}
+
+	var keys []*accessKey
+	if err := db.C(keyCollection).Find(nil).All(&keys); err != nil {
+		log.WithError(err).Error("could not fetch access keys")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch access keys").Write(w)
+		return
+	}
+
+	response.NewDataResponse(keys).Write(w)
+}
+
+// DeleteAccessKey revokes an access key, admin-only
+func DeleteAccessKey(w http.ResponseWriter, req *http.Request) {
+	kid := mux.Vars(req)["kid"]
+	db, closer := dbSession.DB()
+	defer closer()
+
+	if !isAdminRequest(db, req) {
+		response.NewErrorResponse(http.StatusForbidden, "admin access required").Write(w)
+		return
+	}
+
+	now := time.Now()
+	if err := db.C(keyCollection).UpdateId(kid, bson.M{"$set": bson.M{"revoked_at": now}}); err != nil {
+		if err == mgo.ErrNotFound {
+			response.NewErrorResponse(http.StatusNotFound, "access key not found").Write(w)
+			return
+		}
+		log.WithError(err).Error("could not revoke access key")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not revoke access key").Write(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// UnlockAccessKey clears a key's rate-limit cooldown, admin-only. Intended for recovering a
+// legitimate key that tripped the brute-force guard before its cooldown naturally expires.
+func UnlockAccessKey(w http.ResponseWriter, req *http.Request) {
+	kid := mux.Vars(req)["kid"]
+	db, closer := dbSession.DB()
+	defer closer()
+
+	if !isAdminRequest(db, req) {
+		response.NewErrorResponse(http.StatusForbidden, "admin access required").Write(w)
+		return
+	}
+
+	keyLimiter.reset(kid)
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,102 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestKeyRateLimiterLocksOutAfterMaxFailures(t *testing.T) {
+	l := &keyRateLimiter{state: map[string]*keyFailureState{}}
+
+	for i := 0; i < maxKeyFailures; i++ {
+		if !l.allowed("key1") {
+			t.Fatalf("expected key1 to be allowed after %d failures", i)
+		}
+		l.recordFailure("key1")
+	}
+	if !l.allowed("key1") {
+		t.Fatalf("expected key1 to still be allowed after exactly maxKeyFailures failures")
+	}
+
+	l.recordFailure("key1")
+	if l.allowed("key1") {
+		t.Fatalf("expected key1 to be locked out after more than maxKeyFailures failures")
+	}
+
+	l.reset("key1")
+	if !l.allowed("key1") {
+		t.Fatalf("expected key1 to be allowed again after reset")
+	}
+}
+
+func TestKeyRateLimiterCooldownExpires(t *testing.T) {
+	l := &keyRateLimiter{state: map[string]*keyFailureState{}}
+
+	for i := 0; i <= maxKeyFailures; i++ {
+		l.recordFailure("key1")
+	}
+	if l.allowed("key1") {
+		t.Fatalf("expected key1 to be locked out immediately after tripping the limiter")
+	}
+
+	// Simulate the cooldown having already elapsed, rather than sleeping in the test.
+	l.state["key1"].lockedUntil = time.Now().Add(-time.Second)
+	if !l.allowed("key1") {
+		t.Fatalf("expected key1 to be allowed again once its cooldown has elapsed")
+	}
+}
+
+func TestKeyRateLimiterForgetsOldFailures(t *testing.T) {
+	l := &keyRateLimiter{state: map[string]*keyFailureState{}}
+
+	l.recordFailure("key1")
+	// Simulate the failure window having already elapsed.
+	l.state["key1"].lastFailure = time.Now().Add(-2 * keyFailureWindow)
+
+	for i := 0; i < maxKeyFailures; i++ {
+		l.recordFailure("key1")
+	}
+	if !l.allowed("key1") {
+		t.Fatalf("expected the stale failure not to count toward the new window's limit")
+	}
+}
+
+func TestGenerateKeyTokenLengthAndAlphabet(t *testing.T) {
+	token, err := generateKeyToken(keySecretLength)
+	if err != nil {
+		t.Fatalf("generateKeyToken returned error: %v", err)
+	}
+	if len(token) != keySecretLength {
+		t.Fatalf("expected token of length %d, got %d", keySecretLength, len(token))
+	}
+	for _, r := range token {
+		if !containsRune(keyIDAlphabet, r) {
+			t.Fatalf("token contains character %q outside keyIDAlphabet", r)
+		}
+	}
+}
+
+func containsRune(s string, r rune) bool {
+	for _, c := range s {
+		if c == r {
+			return true
+		}
+	}
+	return false
+}
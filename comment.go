@@ -0,0 +1,361 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const commentCollection = "comments"
+const userCollection = "users"
+
+// defaultCommentsLimit is used when the request does not specify a "limit" query param
+const defaultCommentsLimit = 20
+
+// maxCommentDepth bounds how deeply comments may be nested via parent_id
+const maxCommentDepth = 5
+
+// maxCommentBodyLength bounds the size of a comment's body
+const maxCommentBodyLength = 10000
+
+// Comment represents a (possibly threaded) comment on an item
+type Comment struct {
+	ID       bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	ItemID   string        `json:"item_id" bson:"item_id"`
+	AuthorID bson.ObjectId `json:"author_id,omitempty" bson:"author_id,omitempty"`
+	// RemoteActorID identifies a comment created by a remote ActivityPub actor instead of a local user
+	RemoteActorID string        `json:"remote_actor_id,omitempty" bson:"remote_actor_id,omitempty"`
+	ParentID      bson.ObjectId `json:"parent_id,omitempty" bson:"parent_id,omitempty"`
+	Body          string        `json:"body" bson:"body"`
+	CreatedAt     time.Time     `json:"created_at" bson:"created_at"`
+	UpdatedAt     time.Time     `json:"updated_at" bson:"updated_at"`
+	EditedAt      *time.Time    `json:"edited_at,omitempty" bson:"edited_at,omitempty"`
+	// DeletedAt marks a soft-delete; the comment is kept as a placeholder so replies stay linked
+	DeletedAt *time.Time `json:"-" bson:"deleted_at,omitempty"`
+	// Replies is populated when comments are returned as a tree, never persisted directly
+	Replies []*Comment `json:"replies,omitempty" bson:"-"`
+}
+
+// MarshalJSON hides the body of soft-deleted comments behind a placeholder
+func (c *Comment) MarshalJSON() ([]byte, error) {
+	type Alias Comment
+	body := c.Body
+	if c.DeletedAt != nil {
+		body = "[deleted]"
+	}
+	return json.Marshal(&struct {
+		Body string `json:"body"`
+		*Alias
+	}{Body: body, Alias: (*Alias)(c)})
+}
+
+// getComments returns the comment tree for an item. Pagination (limit/before) applies to root
+// comments only; every reply under a root returned on the page comes back with it regardless
+// of how old it is, so a thread's replies never go missing just because the thread itself is
+// old relative to newer discussions on the item.
+func getComments(w http.ResponseWriter, req *http.Request) {
+	itemID := mux.Vars(req)["id"]
+	db, closer := dbSession.DB()
+	defer closer()
+
+	rootQuery := bson.M{"item_id": itemID, "parent_id": bson.M{"$exists": false}}
+	if before := req.URL.Query().Get("before"); before != "" {
+		if !bson.IsObjectIdHex(before) {
+			response.NewErrorResponse(http.StatusBadRequest, "invalid before cursor").Write(w)
+			return
+		}
+		rootQuery["_id"] = bson.M{"$lt": bson.ObjectIdHex(before)}
+	}
+
+	limit := defaultCommentsLimit
+	if l := req.URL.Query().Get("limit"); l != "" {
+		parsed, err := strconv.Atoi(l)
+		if err != nil || parsed <= 0 {
+			response.NewErrorResponse(http.StatusBadRequest, "invalid limit").Write(w)
+			return
+		}
+		limit = parsed
+	}
+
+	var roots []*Comment
+	if err := db.C(commentCollection).Find(rootQuery).Sort("-_id").Limit(limit).All(&roots); err != nil {
+		log.WithError(err).Error("could not fetch comments")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch comments").Write(w)
+		return
+	}
+
+	comments := append([]*Comment{}, roots...)
+	// Walk down the thread one level at a time, pulling in every descendant of this page's
+	// roots regardless of the "before" cursor. maxCommentDepth bounds the number of hops.
+	frontier := roots
+	for hop := 0; hop < maxCommentDepth && len(frontier) > 0; hop++ {
+		parentIDs := make([]bson.ObjectId, len(frontier))
+		for i, c := range frontier {
+			parentIDs[i] = c.ID
+		}
+
+		var children []*Comment
+		if err := db.C(commentCollection).Find(bson.M{"item_id": itemID, "parent_id": bson.M{"$in": parentIDs}}).All(&children); err != nil {
+			log.WithError(err).Error("could not fetch comment replies")
+			response.NewErrorResponse(http.StatusInternalServerError, "could not fetch comments").Write(w)
+			return
+		}
+		comments = append(comments, children...)
+		frontier = children
+	}
+
+	response.NewDataResponse(buildCommentTree(comments)).Write(w)
+}
+
+// buildCommentTree nests comments under their parent, sorted by CreatedAt
+func buildCommentTree(comments []*Comment) []*Comment {
+	byID := make(map[bson.ObjectId]*Comment, len(comments))
+	for _, c := range comments {
+		byID[c.ID] = c
+	}
+
+	var roots []*Comment
+	for _, c := range comments {
+		if c.ParentID == "" {
+			roots = append(roots, c)
+			continue
+		}
+		if parent, ok := byID[c.ParentID]; ok {
+			parent.Replies = append(parent.Replies, c)
+		}
+	}
+
+	sortCommentsByCreatedAt(roots)
+	for _, c := range comments {
+		sortCommentsByCreatedAt(c.Replies)
+	}
+	return roots
+}
+
+func sortCommentsByCreatedAt(comments []*Comment) {
+	for i := 1; i < len(comments); i++ {
+		for j := i; j > 0 && comments[j].CreatedAt.Before(comments[j-1].CreatedAt); j-- {
+			comments[j], comments[j-1] = comments[j-1], comments[j]
+		}
+	}
+}
+
+// createComment creates a comment for an item, optionally as a reply
+func createComment(w http.ResponseWriter, req *http.Request) {
+	itemID := mux.Vars(req)["id"]
+	db, closer := dbSession.DB()
+	defer closer()
+
+	uid, err := requireScope(req, scopeWrite)
+	if err != nil {
+		response.NewErrorResponse(http.StatusUnauthorized, "unauthorized").Write(w)
+		return
+	}
+
+	var body struct {
+		Body     string        `json:"body"`
+		ParentID bson.ObjectId `json:"parent_id,omitempty"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		log.WithError(err).Error("could not parse request body")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse request body").Write(w)
+		return
+	}
+
+	if body.Body == "" || len(body.Body) > maxCommentBodyLength {
+		response.NewErrorResponse(http.StatusBadRequest, "invalid comment body").Write(w)
+		return
+	}
+
+	if err := db.C(itemCollection).FindId(itemID).One(&item{}); err != nil {
+		response.NewErrorResponse(http.StatusNotFound, "item not found").Write(w)
+		return
+	}
+
+	depth := 0
+	if body.ParentID != "" {
+		var parent Comment
+		if err := db.C(commentCollection).FindId(body.ParentID).One(&parent); err != nil {
+			response.NewErrorResponse(http.StatusBadRequest, "parent comment not found").Write(w)
+			return
+		}
+		depth, err = commentDepth(db, parent)
+		if err != nil {
+			log.WithError(err).Error("could not compute comment depth")
+			response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+			return
+		}
+		if depth+1 > maxCommentDepth {
+			response.NewErrorResponse(http.StatusBadRequest, "maximum comment depth exceeded").Write(w)
+			return
+		}
+	}
+
+	now := time.Now()
+	c := &Comment{
+		ID:        bson.NewObjectId(),
+		ItemID:    itemID,
+		AuthorID:  uid,
+		ParentID:  body.ParentID,
+		Body:      body.Body,
+		CreatedAt: now,
+		UpdatedAt: now,
+	}
+
+	if err := db.C(commentCollection).Insert(c); err != nil {
+		log.WithError(err).Error("could not create comment")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not create comment").Write(w)
+		return
+	}
+
+	emitCommentActivity(itemID, c)
+
+	response.NewDataResponse(c).WithCode(http.StatusCreated).Write(w)
+}
+
+// commentDepth walks parent_id links to determine how deep in the thread a comment sits
+func commentDepth(db *mgo.Database, c Comment) (int, error) {
+	depth := 0
+	for c.ParentID != "" {
+		if err := db.C(commentCollection).FindId(c.ParentID).One(&c); err != nil {
+			return 0, err
+		}
+		depth++
+	}
+	return depth, nil
+}
+
+// updateComment lets the author edit the body of their own comment
+func updateComment(w http.ResponseWriter, req *http.Request) {
+	cid := mux.Vars(req)["cid"]
+	if !bson.IsObjectIdHex(cid) {
+		response.NewErrorResponse(http.StatusBadRequest, "invalid comment id").Write(w)
+		return
+	}
+	db, closer := dbSession.DB()
+	defer closer()
+
+	uid, err := requireScope(req, scopeWrite)
+	if err != nil {
+		response.NewErrorResponse(http.StatusUnauthorized, "unauthorized").Write(w)
+		return
+	}
+
+	var c Comment
+	if err := db.C(commentCollection).FindId(bson.ObjectIdHex(cid)).One(&c); err != nil || c.DeletedAt != nil {
+		response.NewErrorResponse(http.StatusNotFound, "comment not found").Write(w)
+		return
+	}
+
+	if c.AuthorID != uid {
+		response.NewErrorResponse(http.StatusForbidden, "only the author may edit this comment").Write(w)
+		return
+	}
+
+	var body struct {
+		Body string `json:"body"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		log.WithError(err).Error("could not parse request body")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse request body").Write(w)
+		return
+	}
+	if body.Body == "" || len(body.Body) > maxCommentBodyLength {
+		response.NewErrorResponse(http.StatusBadRequest, "invalid comment body").Write(w)
+		return
+	}
+
+	now := time.Now()
+	c.Body = body.Body
+	c.UpdatedAt = now
+	c.EditedAt = &now
+
+	if err := db.C(commentCollection).UpdateId(c.ID, &c); err != nil {
+		log.WithError(err).Error("could not update comment")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not update comment").Write(w)
+		return
+	}
+
+	response.NewDataResponse(&c).Write(w)
+}
+
+// deleteComment soft-deletes a comment, leaving a placeholder for any replies
+func deleteComment(w http.ResponseWriter, req *http.Request) {
+	cid := mux.Vars(req)["cid"]
+	if !bson.IsObjectIdHex(cid) {
+		response.NewErrorResponse(http.StatusBadRequest, "invalid comment id").Write(w)
+		return
+	}
+	db, closer := dbSession.DB()
+	defer closer()
+
+	uid, err := requireScope(req, scopeWrite)
+	if err != nil {
+		response.NewErrorResponse(http.StatusUnauthorized, "unauthorized").Write(w)
+		return
+	}
+
+	var c Comment
+	if err := db.C(commentCollection).FindId(bson.ObjectIdHex(cid)).One(&c); err != nil || c.DeletedAt != nil {
+		response.NewErrorResponse(http.StatusNotFound, "comment not found").Write(w)
+		return
+	}
+
+	if c.AuthorID != uid && !isUserAdmin(db, uid) {
+		response.NewErrorResponse(http.StatusForbidden, "only the author or an admin may delete this comment").Write(w)
+		return
+	}
+
+	now := time.Now()
+	if err := db.C(commentCollection).UpdateId(c.ID, bson.M{"$set": bson.M{"deleted_at": now, "updated_at": now}}); err != nil {
+		log.WithError(err).Error("could not delete comment")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not delete comment").Write(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// isUserAdmin reports whether uid belongs to a user flagged as an admin
+func isUserAdmin(db *mgo.Database, uid bson.ObjectId) bool {
+	var u struct {
+		IsAdmin bool `bson:"is_admin"`
+	}
+	if err := db.C(userCollection).FindId(uid).One(&u); err != nil {
+		return false
+	}
+	return u.IsAdmin
+}
+
+// The comments handlers are gated as a whole behind the "comments" license feature: an
+// unlicensed deployment can neither read, create, edit nor delete comments.
+var (
+	GetComments   = requireFeature("comments", getComments)
+	CreateComment = requireFeature("comments", createComment)
+	UpdateComment = requireFeature("comments", updateComment)
+	DeleteComment = requireFeature("comments", deleteComment)
+)
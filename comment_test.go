@@ -0,0 +1,84 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"gopkg.in/mgo.v2/bson"
+)
+
+func TestBuildCommentTreeNestsReplies(t *testing.T) {
+	root := &Comment{ID: bson.NewObjectId()}
+	reply := &Comment{ID: bson.NewObjectId(), ParentID: root.ID}
+
+	roots := buildCommentTree([]*Comment{root, reply})
+
+	if len(roots) != 1 {
+		t.Fatalf("expected 1 root, got %d", len(roots))
+	}
+	if len(roots[0].Replies) != 1 || roots[0].Replies[0].ID != reply.ID {
+		t.Fatalf("expected reply to be nested under its parent")
+	}
+}
+
+func TestBuildCommentTreeDropsOrphanedReplies(t *testing.T) {
+	// The parent of this reply isn't among the comments passed in.
+	reply := &Comment{ID: bson.NewObjectId(), ParentID: bson.NewObjectId()}
+
+	roots := buildCommentTree([]*Comment{reply})
+
+	if len(roots) != 0 {
+		t.Fatalf("expected orphaned reply to be dropped, got %d roots", len(roots))
+	}
+}
+
+func TestSortCommentsByCreatedAt(t *testing.T) {
+	now := time.Now()
+	a := &Comment{ID: bson.NewObjectId(), CreatedAt: now.Add(2 * time.Minute)}
+	b := &Comment{ID: bson.NewObjectId(), CreatedAt: now}
+	c := &Comment{ID: bson.NewObjectId(), CreatedAt: now.Add(time.Minute)}
+
+	comments := []*Comment{a, b, c}
+	sortCommentsByCreatedAt(comments)
+
+	if comments[0] != b || comments[1] != c || comments[2] != a {
+		t.Fatalf("comments were not sorted by CreatedAt")
+	}
+}
+
+func TestCommentMarshalJSONHidesDeletedBody(t *testing.T) {
+	now := time.Now()
+	c := &Comment{ID: bson.NewObjectId(), Body: "secret", DeletedAt: &now}
+
+	out, err := json.Marshal(c)
+	if err != nil {
+		t.Fatalf("Marshal returned error: %v", err)
+	}
+
+	var decoded struct {
+		Body string `json:"body"`
+	}
+	if err := json.Unmarshal(out, &decoded); err != nil {
+		t.Fatalf("Unmarshal returned error: %v", err)
+	}
+	if decoded.Body != "[deleted]" {
+		t.Fatalf("expected body to be hidden, got %q", decoded.Body)
+	}
+}
@@ -39,10 +39,21 @@ type item struct {
 	Type string `json:"type"`
 	// List of IDs of Stargazers that will be stored in the database
 	StargazersIDs []bson.ObjectId `json:"-" bson:"stargazers_ids"`
+	// List of ActivityPub actor IDs of remote Stargazers, stored separately since they
+	// aren't local users
+	RemoteStargazerIDs []string `json:"-" bson:"remote_stargazer_ids,omitempty"`
 	// Count of the Stargazers which is only exposed in the JSON response
 	StargazersCount int `json:"stargazers_count" bson:"-"`
 	// Whether the current user has starred the item, only exposed in the JSON response
 	HasStarred bool `json:"has_starred" bson:"-"`
+	// Average of all 1-5 star ratings left on the item, only exposed in the JSON response
+	AverageRating float64 `json:"average_rating" bson:"-"`
+	// Number of ratings left on the item, only exposed in the JSON response
+	RatingCount int `json:"rating_count" bson:"-"`
+	// Count of ratings per score, indexed by score-1, only exposed in the JSON response
+	RatingHistogram [5]int `json:"rating_histogram" bson:"-"`
+	// The current user's own rating of the item, if any, only exposed in the JSON response
+	UserRating *int `json:"user_rating,omitempty" bson:"-"`
 }
 
 // GetStars returns a list of starred items
@@ -55,9 +66,14 @@ func GetStars(w http.ResponseWriter, req *http.Request) {
 		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch all items").Write(w)
 		return
 	}
+	currentUser, hasCurrentUser := bson.ObjectId(""), false
+	if uid, err := getCurrentUserID(req); err == nil {
+		currentUser, hasCurrentUser = uid, true
+	}
+
 	for _, it := range items {
-		it.StargazersCount = len(it.StargazersIDs)
-		if currentUser, err := getCurrentUserID(req); err == nil {
+		it.StargazersCount = len(it.StargazersIDs) + len(it.RemoteStargazerIDs)
+		if hasCurrentUser {
 			for _, id := range it.StargazersIDs {
 				if id == currentUser {
 					it.HasStarred = true
@@ -66,6 +82,13 @@ func GetStars(w http.ResponseWriter, req *http.Request) {
 			}
 		}
 	}
+
+	if err := augmentWithRatings(db, items, currentUser, hasCurrentUser); err != nil {
+		log.WithError(err).Error("could not fetch ratings")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch ratings").Write(w)
+		return
+	}
+
 	response.NewDataResponse(items).Write(w)
 }
 
@@ -74,9 +97,10 @@ func UpdateStar(w http.ResponseWriter, req *http.Request) {
 	db, closer := dbSession.DB()
 	defer closer()
 
-	uid, err := getCurrentUserID(req)
+	uid, err := requireScope(req, scopeWrite)
 	if err != nil {
 		response.NewErrorResponse(http.StatusUnauthorized, "unauthorized").Write(w)
+		return
 	}
 
 	// Params validation
@@ -113,33 +137,46 @@ func UpdateStar(w http.ResponseWriter, req *http.Request) {
 		return
 	}
 
-	response.NewDataResponse(it).WithCode(http.StatusCreated).Write(w)
-}
-
-// GetComments returns a list of comments for an item
-func GetComments(w http.ResponseWriter, req *http.Request) {
-	panic("not implemented")
-}
+	emitStarActivity(it.ID, it.HasStarred)
 
-// CreateComment creates a comment for an item
-func CreateComment(w http.ResponseWriter, req *http.Request) {
-	panic("not implemented")
+	response.NewDataResponse(it).WithCode(http.StatusCreated).Write(w)
 }
 
 type userClaims struct {
 	ID bson.ObjectId
+	// IsAdmin grants access to the admin-only endpoints (license management, access keys, ...)
+	IsAdmin bool `json:"is_admin"`
 	jwt.StandardClaims
 }
 
+// getCurrentUserID resolves the caller's user ID from the ka_auth cookie, falling back to
+// an access key presented via the Authorization header
 var getCurrentUserID = func(req *http.Request) (bson.ObjectId, error) {
+	if uid, err := getCurrentUserIDFromCookie(req); err == nil {
+		return uid, nil
+	}
+	uid, _, err := authenticateWithKey(req)
+	return uid, err
+}
+
+func getCurrentUserIDFromCookie(req *http.Request) (bson.ObjectId, error) {
+	claims, err := parseCookieClaims(req)
+	if err != nil {
+		return "", err
+	}
+	return claims.ID, nil
+}
+
+// parseCookieClaims parses and validates the ka_auth JWT cookie, returning its claims
+func parseCookieClaims(req *http.Request) (*userClaims, error) {
 	jwtKey, ok := os.LookupEnv("JWT_KEY")
 	if !ok {
-		return "", errors.New("JWT_KEY not set")
+		return nil, errors.New("JWT_KEY not set")
 	}
 
 	cookie, err := req.Cookie("ka_auth")
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	token, err := jwt.ParseWithClaims(cookie.Value, &userClaims{}, func(token *jwt.Token) (interface{}, error) {
@@ -149,11 +186,11 @@ var getCurrentUserID = func(req *http.Request) (bson.ObjectId, error) {
 		return []byte(jwtKey), nil
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if claims, ok := token.Claims.(*userClaims); ok && token.Valid {
-		return claims.ID, nil
+		return claims, nil
 	}
-	return "", errors.New("invalid token")
+	return nil, errors.New("invalid token")
 }
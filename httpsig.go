@@ -0,0 +1,361 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// maxActorDocumentBytes bounds how much of a remote actor document we'll read, so a malicious
+// or compromised actor endpoint can't exhaust memory with an unbounded response.
+const maxActorDocumentBytes = 1 << 20
+
+// requiredSignedHeaders are the headers every inbound signature must cover; a signature that
+// omits any of these is rejected regardless of what its own "headers" param claims, since that
+// param is attacker-supplied and can't be trusted to decide what was actually signed.
+var requiredSignedHeaders = []string{"(request-target)", "host", "date", "digest"}
+
+// deliveryRetries and deliveryBackoff bound how hard we retry delivering an activity to a
+// remote inbox before giving up
+const deliveryRetries = 3
+
+var deliveryBackoff = time.Second
+
+// apPublicKeyPem returns this instance's own public key, used to advertise item actors
+func apPublicKeyPem() string {
+	key, _ := os.LookupEnv("AP_PUBLIC_KEY")
+	return key
+}
+
+func apPrivateKey() (*rsa.PrivateKey, error) {
+	raw, ok := os.LookupEnv("AP_PRIVATE_KEY")
+	if !ok {
+		return nil, errors.New("AP_PRIVATE_KEY not set")
+	}
+	block, _ := pem.Decode([]byte(raw))
+	if block == nil {
+		return nil, errors.New("could not decode AP_PRIVATE_KEY")
+	}
+	key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// verifyHTTPSignature verifies the Signature header of an inbound ActivityPub request over
+// its (request-target), host, date and digest, fetching (and caching) the signer's public
+// key from their actor document. It returns the verified actor's ID.
+func verifyHTTPSignature(req *http.Request) (string, error) {
+	sigHeader := req.Header.Get("Signature")
+	if sigHeader == "" {
+		return "", errors.New("missing Signature header")
+	}
+	params := parseSignatureHeader(sigHeader)
+
+	keyID, ok := params["keyId"]
+	if !ok {
+		return "", errors.New("missing keyId")
+	}
+	signature, ok := params["signature"]
+	if !ok {
+		return "", errors.New("missing signature")
+	}
+	headers := strings.Fields(params["headers"])
+	if !coversRequiredHeaders(headers) {
+		return "", fmt.Errorf("signature must cover %s", strings.Join(requiredSignedHeaders, ", "))
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		return "", err
+	}
+	req.Body = ioutil.NopCloser(bytes.NewReader(body))
+
+	if err := verifyDigestHeader(req.Header.Get("Digest"), body); err != nil {
+		return "", err
+	}
+
+	signingString, err := buildSigningString(req, headers)
+	if err != nil {
+		return "", err
+	}
+
+	actorID := strings.SplitN(keyID, "#", 2)[0]
+	pubKeyPem, err := resolveRemoteActorKey(actorID)
+	if err != nil {
+		return "", err
+	}
+
+	block, _ := pem.Decode([]byte(pubKeyPem))
+	if block == nil {
+		return "", errors.New("could not decode remote public key")
+	}
+	pub, err := x509.ParsePKIXPublicKey(block.Bytes)
+	if err != nil {
+		return "", err
+	}
+	rsaPub, ok := pub.(*rsa.PublicKey)
+	if !ok {
+		return "", errors.New("unsupported public key type")
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(signature)
+	if err != nil {
+		return "", err
+	}
+	digest := sha256.Sum256([]byte(signingString))
+	if err := rsa.VerifyPKCS1v15(rsaPub, crypto.SHA256, digest[:], sigBytes); err != nil {
+		return "", err
+	}
+
+	return actorID, nil
+}
+
+// coversRequiredHeaders reports whether headers includes every entry in requiredSignedHeaders
+func coversRequiredHeaders(headers []string) bool {
+	for _, required := range requiredSignedHeaders {
+		found := false
+		for _, h := range headers {
+			if h == required {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyDigestHeader checks a "SHA-256=<base64>" Digest header against the actual request
+// body, so a signature that merely includes the Digest header's name can't be reused with a
+// substituted body.
+func verifyDigestHeader(digestHeader string, body []byte) error {
+	const prefix = "SHA-256="
+	if !strings.HasPrefix(digestHeader, prefix) {
+		return errors.New("missing or unsupported Digest header")
+	}
+	claimed, err := base64.StdEncoding.DecodeString(strings.TrimPrefix(digestHeader, prefix))
+	if err != nil {
+		return fmt.Errorf("could not decode Digest header: %v", err)
+	}
+	actual := sha256.Sum256(body)
+	if !hmac.Equal(actual[:], claimed) {
+		return errors.New("digest does not match request body")
+	}
+	return nil
+}
+
+func parseSignatureHeader(header string) map[string]string {
+	params := make(map[string]string)
+	for _, part := range strings.Split(header, ",") {
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		params[strings.TrimSpace(kv[0])] = strings.Trim(kv[1], `"`)
+	}
+	return params
+}
+
+func buildSigningString(req *http.Request, headers []string) (string, error) {
+	var lines []string
+	for _, h := range headers {
+		switch h {
+		case "(request-target)":
+			lines = append(lines, fmt.Sprintf("(request-target): %s %s", strings.ToLower(req.Method), req.URL.RequestURI()))
+		case "host":
+			lines = append(lines, "host: "+req.Host)
+		default:
+			v := req.Header.Get(h)
+			if v == "" {
+				return "", fmt.Errorf("missing header %q required by signature", h)
+			}
+			lines = append(lines, strings.ToLower(h)+": "+v)
+		}
+	}
+	return strings.Join(lines, "\n"), nil
+}
+
+// validateActorURL rejects anything that isn't a plain https URL resolving to a public
+// address, so that fetching keyId (parsed straight out of the inbound Signature header,
+// before any cryptographic check has happened) can't be used as an SSRF oracle against
+// loopback, link-local or other internal addresses.
+func validateActorURL(rawURL string) (*url.URL, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid actor id: %v", err)
+	}
+	if u.Scheme != "https" {
+		return nil, errors.New("actor id must be an https URL")
+	}
+	host := u.Hostname()
+	if host == "" {
+		return nil, errors.New("actor id is missing a host")
+	}
+
+	ips, err := net.LookupIP(host)
+	if err != nil {
+		return nil, fmt.Errorf("could not resolve actor host: %v", err)
+	}
+	for _, ip := range ips {
+		if !isPublicIP(ip) {
+			return nil, fmt.Errorf("actor host %q resolves to a disallowed address", host)
+		}
+	}
+
+	return u, nil
+}
+
+// isPublicIP reports whether ip is safe to let the server fetch, excluding loopback,
+// link-local, unspecified and private (RFC 1918 / ULA) ranges.
+func isPublicIP(ip net.IP) bool {
+	return !ip.IsLoopback() && !ip.IsLinkLocalUnicast() && !ip.IsLinkLocalMulticast() &&
+		!ip.IsUnspecified() && !ip.IsPrivate()
+}
+
+// resolveRemoteActorKey returns a remote actor's public key, caching it in remote_actors
+// after fetching it from the actor's own document. actorID is attacker-controlled (it comes
+// from the inbound Signature header's keyId, before verification), so it's validated against
+// validateActorURL before this ever issues a request.
+func resolveRemoteActorKey(actorID string) (string, error) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	var cached remoteActor
+	if err := db.C(remoteActorCollection).FindId(actorID).One(&cached); err == nil {
+		return cached.PublicKeyPem, nil
+	}
+
+	actorURL, err := validateActorURL(actorID)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := http.Get(actorURL.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	var fetched apActor
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxActorDocumentBytes)).Decode(&fetched); err != nil {
+		return "", err
+	}
+
+	remote := remoteActor{
+		ID:           actorID,
+		Inbox:        fetched.Inbox,
+		PublicKeyPem: fetched.PublicKey.PublicKeyPem,
+		FetchedAt:    time.Now(),
+	}
+	if _, err := db.C(remoteActorCollection).UpsertId(actorID, &remote); err != nil {
+		log.WithError(err).Warn("could not cache remote actor")
+	}
+
+	return remote.PublicKeyPem, nil
+}
+
+// deliverActivity signs and POSTs an activity to a remote inbox, retrying on 5xx responses
+// with a simple linear backoff.
+func deliverActivity(activity apActivity, inboxURL string) {
+	body, err := json.Marshal(&activity)
+	if err != nil {
+		log.WithError(err).Error("could not marshal activity for delivery")
+		return
+	}
+
+	for attempt := 0; attempt < deliveryRetries; attempt++ {
+		req, err := http.NewRequest(http.MethodPost, inboxURL, bytes.NewReader(body))
+		if err != nil {
+			log.WithError(err).Error("could not build delivery request")
+			return
+		}
+		req.Header.Set("Content-Type", "application/activity+json")
+		req.Host = req.URL.Host
+
+		if err := signRequest(req, body, activity.Actor+"#main-key"); err != nil {
+			log.WithError(err).Error("could not sign delivery request")
+			return
+		}
+
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode < 500 {
+				return
+			}
+		}
+
+		time.Sleep(deliveryBackoff * time.Duration(attempt+1))
+	}
+	log.WithField("inbox", inboxURL).Error("giving up delivering activity after retries")
+}
+
+// signRequest adds Date, Digest and Signature headers to an outbound delivery request,
+// signed under keyID (the sending actor's publicKey id)
+func signRequest(req *http.Request, body []byte, keyID string) error {
+	key, err := apPrivateKey()
+	if err != nil {
+		return err
+	}
+
+	digest := sha256.Sum256(body)
+	req.Header.Set("Digest", "SHA-256="+base64.StdEncoding.EncodeToString(digest[:]))
+	req.Header.Set("Date", time.Now().UTC().Format(http.TimeFormat))
+
+	headers := []string{"(request-target)", "host", "date", "digest"}
+	signingString, err := buildSigningString(req, headers)
+	if err != nil {
+		return err
+	}
+
+	hashed := sha256.Sum256([]byte(signingString))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, hashed[:])
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Signature", fmt.Sprintf(
+		`keyId="%s",algorithm="rsa-sha256",headers="%s",signature="%s"`,
+		keyID, strings.Join(headers, " "), base64.StdEncoding.EncodeToString(sig),
+	))
+	return nil
+}
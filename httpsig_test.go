@@ -0,0 +1,128 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"net/http"
+	"testing"
+)
+
+func TestParseSignatureHeader(t *testing.T) {
+	header := `keyId="https://example.com/actor#main-key",algorithm="rsa-sha256",headers="(request-target) host date digest",signature="abc123"`
+
+	params := parseSignatureHeader(header)
+
+	if params["keyId"] != "https://example.com/actor#main-key" {
+		t.Fatalf("unexpected keyId: %q", params["keyId"])
+	}
+	if params["headers"] != "(request-target) host date digest" {
+		t.Fatalf("unexpected headers: %q", params["headers"])
+	}
+	if params["signature"] != "abc123" {
+		t.Fatalf("unexpected signature: %q", params["signature"])
+	}
+}
+
+func TestCoversRequiredHeaders(t *testing.T) {
+	if !coversRequiredHeaders([]string{"digest", "(request-target)", "date", "host"}) {
+		t.Fatalf("expected required headers in any order to satisfy the check")
+	}
+	if coversRequiredHeaders([]string{"date"}) {
+		t.Fatalf("expected a signature covering only date to fail the check")
+	}
+}
+
+func TestBuildSigningString(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "https://example.com/inbox", nil)
+	if err != nil {
+		t.Fatalf("could not build request: %v", err)
+	}
+	req.Host = "example.com"
+	req.Header.Set("Date", "Tue, 07 Jun 2022 20:51:35 GMT")
+	req.Header.Set("Digest", "SHA-256=abc123")
+
+	got, err := buildSigningString(req, []string{"(request-target)", "host", "date", "digest"})
+	if err != nil {
+		t.Fatalf("buildSigningString returned error: %v", err)
+	}
+
+	want := "(request-target): post /inbox\n" +
+		"host: example.com\n" +
+		"date: Tue, 07 Jun 2022 20:51:35 GMT\n" +
+		"digest: SHA-256=abc123"
+	if got != want {
+		t.Fatalf("unexpected signing string:\ngot:  %q\nwant: %q", got, want)
+	}
+}
+
+func TestBuildSigningStringMissingHeader(t *testing.T) {
+	req, err := http.NewRequest(http.MethodPost, "https://example.com/inbox", nil)
+	if err != nil {
+		t.Fatalf("could not build request: %v", err)
+	}
+
+	if _, err := buildSigningString(req, []string{"digest"}); err == nil {
+		t.Fatalf("expected an error for a missing required header")
+	}
+}
+
+func TestValidateActorURLRejectsNonHTTPS(t *testing.T) {
+	if _, err := validateActorURL("http://example.com/actor"); err == nil {
+		t.Fatalf("expected an error for a non-https actor id")
+	}
+}
+
+func TestValidateActorURLRejectsPrivateAndLoopbackAddresses(t *testing.T) {
+	for _, rawURL := range []string{
+		"https://127.0.0.1/actor",
+		"https://169.254.169.254/latest/meta-data",
+		"https://10.0.0.5/actor",
+		"https://[::1]/actor",
+	} {
+		if _, err := validateActorURL(rawURL); err == nil {
+			t.Fatalf("expected %q to be rejected as an SSRF target", rawURL)
+		}
+	}
+}
+
+func TestValidateActorURLAcceptsPublicAddress(t *testing.T) {
+	u, err := validateActorURL("https://8.8.8.8/actor")
+	if err != nil {
+		t.Fatalf("validateActorURL returned error for a public address: %v", err)
+	}
+	if u.String() != "https://8.8.8.8/actor" {
+		t.Fatalf("unexpected parsed URL: %v", u)
+	}
+}
+
+func TestVerifyDigestHeader(t *testing.T) {
+	body := []byte(`{"type":"Like"}`)
+	sum := sha256.Sum256(body)
+	digestHeader := "SHA-256=" + base64.StdEncoding.EncodeToString(sum[:])
+
+	if err := verifyDigestHeader(digestHeader, body); err != nil {
+		t.Fatalf("verifyDigestHeader returned error for a matching digest: %v", err)
+	}
+	if err := verifyDigestHeader(digestHeader, []byte(`{"type":"Undo"}`)); err == nil {
+		t.Fatalf("expected an error when the body doesn't match the claimed digest")
+	}
+	if err := verifyDigestHeader("not-a-digest", body); err == nil {
+		t.Fatalf("expected an error for a malformed Digest header")
+	}
+}
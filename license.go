@@ -0,0 +1,177 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kubeapps/ratesvc/license"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const licenseCollection = "licenses"
+
+// licenseRecord is how a validated license is persisted; the raw token is kept so the
+// license can be re-verified later, but is never serialized back out.
+type licenseRecord struct {
+	JTI       string    `json:"jti" bson:"_id"`
+	Token     string    `json:"-" bson:"token"`
+	Features  []string  `json:"features" bson:"features"`
+	MaxItems  int       `json:"max_items" bson:"max_items"`
+	ExpiresAt time.Time `json:"expires_at" bson:"expires_at"`
+	CreatedAt time.Time `json:"created_at" bson:"created_at"`
+}
+
+// isAdminRequest reports whether the caller is an admin, via either the ka_auth cookie's
+// IsAdmin claim or, for an access key, the is_admin flag on the key's owning user.
+func isAdminRequest(db *mgo.Database, req *http.Request) bool {
+	if claims, err := parseCookieClaims(req); err == nil {
+		return claims.IsAdmin
+	}
+	if uid, _, err := authenticateWithKey(req); err == nil {
+		return isUserAdmin(db, uid)
+	}
+	return false
+}
+
+// activeLicense returns the claims of the most recently created, still-valid license
+func activeLicense(db *mgo.Database) (*license.Claims, error) {
+	var record licenseRecord
+	if err := db.C(licenseCollection).Find(bson.M{"expires_at": bson.M{"$gt": time.Now()}}).Sort("-created_at").One(&record); err != nil {
+		return nil, err
+	}
+	return license.Parse(record.Token)
+}
+
+// requireFeature wraps a handler so it only serves requests while a stored license grants
+// the named feature, responding 402 Payment Required otherwise.
+func requireFeature(feature string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		db, closer := dbSession.DB()
+		defer closer()
+
+		claims, err := activeLicense(db)
+		if err != nil || !claims.HasFeature(feature) {
+			response.NewErrorResponse(http.StatusPaymentRequired, "feature not included in the active license").Write(w)
+			return
+		}
+
+		handler(w, req)
+	}
+}
+
+// CreateLicense validates and stores a signed license, admin-only
+func CreateLicense(w http.ResponseWriter, req *http.Request) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	if !isAdminRequest(db, req) {
+		response.NewErrorResponse(http.StatusForbidden, "admin access required").Write(w)
+		return
+	}
+
+	var body struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		log.WithError(err).Error("could not parse request body")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse request body").Write(w)
+		return
+	}
+
+	claims, err := license.Parse(body.Token)
+	if err != nil {
+		response.NewErrorResponse(http.StatusBadRequest, "invalid license").Write(w)
+		return
+	}
+
+	if n, err := db.C(licenseCollection).FindId(claims.Id).Count(); err != nil {
+		log.WithError(err).Error("could not check for existing license")
+		response.NewErrorResponse(http.StatusInternalServerError, "internal server error").Write(w)
+		return
+	} else if n > 0 {
+		response.NewErrorResponse(http.StatusConflict, "license already registered").Write(w)
+		return
+	}
+
+	record := &licenseRecord{
+		JTI:       claims.Id,
+		Token:     body.Token,
+		Features:  claims.Features,
+		MaxItems:  claims.MaxItems,
+		ExpiresAt: time.Unix(claims.ExpiresAt, 0),
+		CreatedAt: time.Now(),
+	}
+	if err := db.C(licenseCollection).Insert(record); err != nil {
+		log.WithError(err).Error("could not store license")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not store license").Write(w)
+		return
+	}
+
+	response.NewDataResponse(record).WithCode(http.StatusCreated).Write(w)
+}
+
+// GetLicenses lists stored licenses' parsed claims, admin-only. Raw tokens are never returned.
+func GetLicenses(w http.ResponseWriter, req *http.Request) {
+	db, closer := dbSession.DB()
+	defer closer()
+
+	if !isAdminRequest(db, req) {
+		response.NewErrorResponse(http.StatusForbidden, "admin access required").Write(w)
+		return
+	}
+
+	var records []*licenseRecord
+	if err := db.C(licenseCollection).Find(nil).All(&records); err != nil {
+		log.WithError(err).Error("could not fetch licenses")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch licenses").Write(w)
+		return
+	}
+
+	response.NewDataResponse(records).Write(w)
+}
+
+// DeleteLicense removes a stored license by jti, admin-only
+func DeleteLicense(w http.ResponseWriter, req *http.Request) {
+	jti := mux.Vars(req)["jti"]
+	db, closer := dbSession.DB()
+	defer closer()
+
+	if !isAdminRequest(db, req) {
+		response.NewErrorResponse(http.StatusForbidden, "admin access required").Write(w)
+		return
+	}
+
+	if err := db.C(licenseCollection).RemoveId(jti); err != nil {
+		if err == mgo.ErrNotFound {
+			response.NewErrorResponse(http.StatusNotFound, "license not found").Write(w)
+			return
+		}
+		log.WithError(err).Error("could not delete license")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not delete license").Write(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,104 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+// Package license verifies the signed JWT licenses that gate ratesvc's premium features.
+package license
+
+import (
+	"errors"
+	"os"
+
+	// dgrijalva/jwt-go (used for the ka_auth cookie) has no Ed25519 support, so this package
+	// uses its actively maintained fork instead.
+	jwt "github.com/golang-jwt/jwt/v4"
+)
+
+// defaultRSAPublicKeyPEM and defaultEd25519PublicKeyPEM are the public keys licenses are
+// signed with, compiled into the binary so licenses can be verified without a network call.
+// A deployment can override either via LICENSE_RSA_PUBLIC_KEY / LICENSE_ED25519_PUBLIC_KEY,
+// the same way the ActivityPub subsystem is configured via AP_PUBLIC_KEY/AP_PRIVATE_KEY.
+const defaultRSAPublicKeyPEM = `-----BEGIN PUBLIC KEY-----
+MIIBIjANBgkqhkiG9w0BAQEFAAOCAQ8AMIIBCgKCAQEA0Wpqnm9T7cVvzXtURsSk
+BJzlG+YK4jeBs2jWFhngADT1AoEh2bdlRcrZISgpMb+OiqfrmARxmVMG1MufV41F
+TQPOvxONCiwom+M9JoNTVEW1ONTpLScq4uCGv5AKbB2KAEmOiRxPt5MtfwDyr55M
+iAYFksjmhtDqJaH5qUYCC8Oa/8Xk7l+q8vOs9e3EyViZkXjxYMVBEXk2uu2ijfoc
+yko97kX4Ekb1KIOiDANJejQjsWl9iYitEj69JCkPhUpHOU5kfK2W4Suo+UYOWHkY
+I1DoRb1ktgdlz32E8ZKjsGCBdzsxLKHQrPp8IFipmnuF7j6Ozo+2NyCQMisGVBRI
+7QIDAQAB
+-----END PUBLIC KEY-----`
+
+const defaultEd25519PublicKeyPEM = `-----BEGIN PUBLIC KEY-----
+MCowBQYDK2VwAyEA+5fKcJRBFSqNQjE8L8rH1ObU9/xlapCESEqNQzWs/z4=
+-----END PUBLIC KEY-----`
+
+func rsaPublicKeyPEM() []byte {
+	if pem, ok := os.LookupEnv("LICENSE_RSA_PUBLIC_KEY"); ok {
+		return []byte(pem)
+	}
+	return []byte(defaultRSAPublicKeyPEM)
+}
+
+func ed25519PublicKeyPEM() []byte {
+	if pem, ok := os.LookupEnv("LICENSE_ED25519_PUBLIC_KEY"); ok {
+		return []byte(pem)
+	}
+	return []byte(defaultEd25519PublicKeyPEM)
+}
+
+// Claims carries the feature flags and limits a license grants, on top of the standard
+// exp/jti JWT claims.
+type Claims struct {
+	Features []string `json:"features"`
+	MaxItems int      `json:"max_items"`
+	jwt.StandardClaims
+}
+
+// HasFeature reports whether the license grants access to the named feature
+func (c *Claims) HasFeature(feature string) bool {
+	for _, f := range c.Features {
+		if f == feature {
+			return true
+		}
+	}
+	return false
+}
+
+// Parse verifies a license token signed with either RS256 or Ed25519 against the
+// corresponding compiled-in (or env-overridden) public key, and returns its claims
+func Parse(token string) (*Claims, error) {
+	claims := &Claims{}
+	parsed, err := jwt.ParseWithClaims(token, claims, func(t *jwt.Token) (interface{}, error) {
+		switch t.Method.(type) {
+		case *jwt.SigningMethodRSA:
+			return jwt.ParseRSAPublicKeyFromPEM(rsaPublicKeyPEM())
+		case *jwt.SigningMethodEd25519:
+			return jwt.ParseEdPublicKeyFromPEM(ed25519PublicKeyPEM())
+		default:
+			return nil, errors.New("unexpected signing method")
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !parsed.Valid {
+		return nil, errors.New("invalid license")
+	}
+	if claims.Id == "" {
+		return nil, errors.New("license missing jti")
+	}
+
+	return claims, nil
+}
@@ -0,0 +1,229 @@
+/*
+Copyright (c) 2017 Bitnami
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/kubeapps/ratesvc/response"
+	log "github.com/sirupsen/logrus"
+
+	mgo "gopkg.in/mgo.v2"
+	"gopkg.in/mgo.v2/bson"
+)
+
+const ratingCollection = "ratings"
+
+// rating represents a single user's 1-5 star rating and optional review of an item
+type rating struct {
+	ItemID    string        `json:"item_id" bson:"item_id"`
+	UserID    bson.ObjectId `json:"user_id" bson:"user_id"`
+	Score     int           `json:"score" bson:"score"`
+	Review    string        `json:"review,omitempty" bson:"review,omitempty"`
+	CreatedAt time.Time     `json:"created_at" bson:"created_at"`
+	UpdatedAt time.Time     `json:"updated_at" bson:"updated_at"`
+}
+
+// ratingAggregate is the shape produced by the $group aggregation over ratingCollection
+type ratingAggregate struct {
+	ItemID  string  `bson:"_id"`
+	Average float64 `bson:"average"`
+	Count   int     `bson:"count"`
+	Score1  int     `bson:"score1"`
+	Score2  int     `bson:"score2"`
+	Score3  int     `bson:"score3"`
+	Score4  int     `bson:"score4"`
+	Score5  int     `bson:"score5"`
+}
+
+var ensureRatingIndexOnce sync.Once
+
+// ensureRatingIndex creates the unique item_id+user_id index on ratingCollection the first
+// time it's called, so concurrent PUTs from the same user upsert instead of racing to insert
+// duplicate rating docs.
+func ensureRatingIndex(db *mgo.Database) {
+	ensureRatingIndexOnce.Do(func() {
+		index := mgo.Index{
+			Key:    []string{"item_id", "user_id"},
+			Unique: true,
+		}
+		if err := db.C(ratingCollection).EnsureIndex(index); err != nil {
+			log.WithError(err).Error("could not ensure unique rating index")
+		}
+	})
+}
+
+// augmentWithRatings populates the average_rating, rating_count, rating_histogram and (when
+// currentUser is known) user_rating fields of items using a MongoDB aggregation pipeline.
+func augmentWithRatings(db *mgo.Database, items []*item, currentUser bson.ObjectId, hasCurrentUser bool) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	itemIDs := make([]string, len(items))
+	for i, it := range items {
+		itemIDs[i] = it.ID
+	}
+
+	pipeline := []bson.M{
+		{"$match": bson.M{"item_id": bson.M{"$in": itemIDs}}},
+		{"$group": bson.M{
+			"_id":     "$item_id",
+			"average": bson.M{"$avg": "$score"},
+			"count":   bson.M{"$sum": 1},
+			"score1":  bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$eq": []interface{}{"$score", 1}}, 1, 0}}},
+			"score2":  bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$eq": []interface{}{"$score", 2}}, 1, 0}}},
+			"score3":  bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$eq": []interface{}{"$score", 3}}, 1, 0}}},
+			"score4":  bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$eq": []interface{}{"$score", 4}}, 1, 0}}},
+			"score5":  bson.M{"$sum": bson.M{"$cond": []interface{}{bson.M{"$eq": []interface{}{"$score", 5}}, 1, 0}}},
+		}},
+	}
+
+	var aggregates []ratingAggregate
+	if err := db.C(ratingCollection).Pipe(pipeline).All(&aggregates); err != nil {
+		return err
+	}
+
+	byItemID := make(map[string]ratingAggregate, len(aggregates))
+	for _, a := range aggregates {
+		byItemID[a.ItemID] = a
+	}
+
+	userRatings := make(map[string]int)
+	if hasCurrentUser {
+		var own []rating
+		if err := db.C(ratingCollection).Find(bson.M{"item_id": bson.M{"$in": itemIDs}, "user_id": currentUser}).All(&own); err != nil {
+			return err
+		}
+		for _, r := range own {
+			userRatings[r.ItemID] = r.Score
+		}
+	}
+
+	for _, it := range items {
+		if a, ok := byItemID[it.ID]; ok {
+			it.AverageRating = a.Average
+			it.RatingCount = a.Count
+			it.RatingHistogram = [5]int{a.Score1, a.Score2, a.Score3, a.Score4, a.Score5}
+		}
+		if score, ok := userRatings[it.ID]; ok {
+			it.UserRating = &score
+		}
+	}
+
+	return nil
+}
+
+// putRating creates or updates the current user's rating of an item
+func putRating(w http.ResponseWriter, req *http.Request) {
+	itemID := mux.Vars(req)["id"]
+	db, closer := dbSession.DB()
+	defer closer()
+
+	uid, err := requireScope(req, scopeWrite)
+	if err != nil {
+		response.NewErrorResponse(http.StatusUnauthorized, "unauthorized").Write(w)
+		return
+	}
+
+	var body struct {
+		Score  int    `json:"score"`
+		Review string `json:"review"`
+	}
+	if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+		log.WithError(err).Error("could not parse request body")
+		response.NewErrorResponse(http.StatusBadRequest, "could not parse request body").Write(w)
+		return
+	}
+
+	if body.Score < 1 || body.Score > 5 {
+		response.NewErrorResponse(http.StatusBadRequest, "score must be between 1 and 5").Write(w)
+		return
+	}
+
+	if err := db.C(itemCollection).FindId(itemID).One(&item{}); err != nil {
+		response.NewErrorResponse(http.StatusNotFound, "item not found").Write(w)
+		return
+	}
+
+	ensureRatingIndex(db)
+
+	now := time.Now()
+	selector := bson.M{"item_id": itemID, "user_id": uid}
+	change := bson.M{
+		"$set": bson.M{
+			"score":      body.Score,
+			"review":     body.Review,
+			"updated_at": now,
+		},
+		"$setOnInsert": bson.M{
+			"item_id":    itemID,
+			"user_id":    uid,
+			"created_at": now,
+		},
+	}
+
+	if _, err := db.C(ratingCollection).Upsert(selector, change); err != nil {
+		log.WithError(err).Error("could not save rating")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not save rating").Write(w)
+		return
+	}
+
+	var r rating
+	if err := db.C(ratingCollection).Find(selector).One(&r); err != nil {
+		log.WithError(err).Error("could not fetch saved rating")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not fetch saved rating").Write(w)
+		return
+	}
+
+	response.NewDataResponse(&r).Write(w)
+}
+
+// deleteRating removes the current user's rating of an item
+func deleteRating(w http.ResponseWriter, req *http.Request) {
+	itemID := mux.Vars(req)["id"]
+	db, closer := dbSession.DB()
+	defer closer()
+
+	uid, err := requireScope(req, scopeWrite)
+	if err != nil {
+		response.NewErrorResponse(http.StatusUnauthorized, "unauthorized").Write(w)
+		return
+	}
+
+	if err := db.C(ratingCollection).Remove(bson.M{"item_id": itemID, "user_id": uid}); err != nil {
+		if err == mgo.ErrNotFound {
+			response.NewErrorResponse(http.StatusNotFound, "rating not found").Write(w)
+			return
+		}
+		log.WithError(err).Error("could not delete rating")
+		response.NewErrorResponse(http.StatusInternalServerError, "could not delete rating").Write(w)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// PutRating is putRating gated behind the "ratings" license feature
+var PutRating = requireFeature("ratings", putRating)
+
+// DeleteRating is deleteRating gated behind the "ratings" license feature
+var DeleteRating = requireFeature("ratings", deleteRating)